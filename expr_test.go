@@ -1,6 +1,9 @@
 package expr
 
-import "testing"
+import (
+	"fmt"
+	"testing"
+)
 
 func TestParse(t *testing.T) {
 	// The String method adds parens everywhere, so it is an easy
@@ -112,6 +115,27 @@ func TestParse(t *testing.T) {
 		{"(x < y && z || 1)", "(((x < y) && z) || 1)"},
 		{"(u == v && x == y || w == z)", "(((u == v) && (x == y)) || (w == z))"},
 		{"(u == v*3 && x == y-2 || w == !z)", "(((u == (v * 3)) && (x == (y - 2))) || (w == (!z)))"},
+
+		// Call expressions.
+		{"f()", "f()"},
+		{"f(x)", "f(x)"},
+		{"f(x, y)", "f(x, y)"},
+		{"f(x, y, z)", "f(x, y, z)"},
+		{"f(x + y, g(z))", "f((x + y), g(z))"},
+		{"1 + f(x)", "(1 + f(x))"},
+
+		// String literals.
+		{`"hello"`, `"hello"`},
+		{`""`, `""`},
+		{`"a" + "b"`, `("a" + "b")`},
+		{`"a\nb\t\"c\"\\"`, `"a\nb\t\"c\"\\"`},
+		{`f("x")`, `f("x")`},
+
+		// Let and ternary.
+		{"let x = a + b in x * x", "(let x = (a + b) in (x * x))"},
+		{"let x = 1 in let y = 2 in x + y", "(let x = 1 in (let y = 2 in (x + y)))"},
+		{"cond ? a : b", "(cond ? a : b)"},
+		{"x > y ? x : y", "((x > y) ? x : y)"},
 	}
 	for _, test := range tests {
 		e, err := Parse(test.in)
@@ -143,12 +167,19 @@ func TestParseError(t *testing.T) {
 		expr string
 		err  string
 	}{
-		{"x x", `syntax error at "x"`},
-		{"(x + ", `unexpected eof`},
-		{"(x + 1", `unclosed paren at eof`},
-		{"(x + 1))", `syntax error at ")"`},
-		{"x + >4", `bad expression at ">4"`},
-		{"x @ 4", `syntax error at "@ 4"`},
+		{"x x", `expr:1:3: syntax error at "x"`},
+		{"(x + ", `expr:1:6: unexpected eof`},
+		{"(x + 1", `expr:1:7: unclosed paren at eof`},
+		{"(x + 1))", `expr:1:8: syntax error at ")"`},
+		{"x + >4", `expr:1:5: bad expression at ">4"`},
+		{"x @ 4", `expr:1:3: syntax error at "@ 4"`},
+		{"f(x", `expr:1:4: unclosed call to f at eof`},
+		{"f(x,", `expr:1:5: unexpected eof`},
+		{"let = 1 in x", `expr:1:5: expected identifier after let at "= 1 in x"`},
+		{"let x 1 in x", `expr:1:8: expected '=' after let x at " in x"`},
+		{"let x = 1 x", `expr:1:11: expected 'in' in let at "x"`},
+		{"let x = 1 in", `expr:1:13: unexpected eof`},
+		{"1 ? 2", `expr:1:6: expected ':' in conditional expression at eof`},
 	}
 	for _, test := range tests {
 		_, err := Parse(test.expr)
@@ -254,7 +285,7 @@ func TestEval(t *testing.T) {
 		}
 		vars["x"] = test.x
 		vars["y"] = test.y
-		got, err := e.Eval(vars, ReturnZero)
+		got, err := e.EvalInt(vars, ReturnZero)
 		if err != nil {
 			t.Errorf("Evaluating %s: %v", test.expr, err)
 			continue
@@ -270,11 +301,11 @@ func TestEvalError(t *testing.T) {
 		expr string
 		err  string
 	}{
-		{"y", `undefined variable y`},
-		{"x / 0", `division by zero`},
-		{"x % 0", `modulo by zero`},
-		{"x << -1", `negative left shift amount`},
-		{"x >> -1", `negative right shift amount`},
+		{"y", `expr:1:1: undefined variable y`},
+		{"x / 0", `expr:1:3: division by zero`},
+		{"x % 0", `expr:1:3: modulo by zero`},
+		{"x << -1", `expr:1:3: negative left shift amount`},
+		{"x >> -1", `expr:1:3: negative right shift amount`},
 	}
 	vars := map[string]int{"x": 1}
 	for _, test := range tests {
@@ -283,7 +314,7 @@ func TestEvalError(t *testing.T) {
 			t.Errorf("Parsing %s: %v", test.expr, err)
 			continue
 		}
-		_, err = e.Eval(vars, ReturnError)
+		_, err = e.EvalInt(vars, ReturnError)
 		if err == nil {
 			t.Errorf("Evaluating %s: no error", test.expr)
 			continue
@@ -295,3 +326,671 @@ func TestEvalError(t *testing.T) {
 		}
 	}
 }
+
+func TestCallEval(t *testing.T) {
+	var tests = []struct {
+		expr   string
+		result int
+	}{
+		{"min(3, 1, 2)", 1},
+		{"max(3, 1, 2)", 3},
+		{"abs(-5)", 5},
+		{"abs(5)", 5},
+		{"len(1, 2, 3, 4)", 4},
+		{"len()", 0},
+		{"min(x, y) + max(x, y)", 17},
+		{"double(21)", 42},
+	}
+	funcs := map[string]Func{
+		"double": func(args []int) (int, error) { return args[0] * 2, nil },
+	}
+	vars := map[string]int{"x": 7, "y": 10}
+	for _, test := range tests {
+		e, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parsing %s: %v", test.expr, err)
+			continue
+		}
+		got, err := e.EvalIntWith(Config{Vars: vars, Funcs: funcs}, ReturnError)
+		if err != nil {
+			t.Errorf("Evaluating %s: %v", test.expr, err)
+			continue
+		}
+		if got != test.result {
+			t.Errorf("Evaluating %s: got %d, want %d", test.expr, got, test.result)
+		}
+	}
+}
+
+func TestCallEvalError(t *testing.T) {
+	var tests = []struct {
+		expr string
+		err  string
+	}{
+		{"nope(1)", `expr:1:1: undefined function nope`},
+		{"abs()", `expr:1:1: abs: exactly one argument required`},
+		{"abs(1, 2)", `expr:1:1: abs: exactly one argument required`},
+		{"min()", `expr:1:1: min: at least one argument required`},
+	}
+	for _, test := range tests {
+		e, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parsing %s: %v", test.expr, err)
+			continue
+		}
+		_, err = e.EvalInt(nil, ReturnError)
+		if err == nil {
+			t.Errorf("Evaluating %s: no error", test.expr)
+			continue
+		}
+		if got := err.Error(); got != test.err {
+			t.Errorf("Wrong error for %s: got %q, want %q", test.expr, got, test.err)
+		}
+	}
+}
+
+func TestPos(t *testing.T) {
+	var tests = []struct {
+		expr string
+		pos  Position
+	}{
+		{"3", Position{1, 1, 0}},
+		{"x", Position{1, 1, 0}},
+		{"  x", Position{1, 3, 2}},
+		{"x + y", Position{1, 3, 2}},   // Position of the '+'.
+		{"-x", Position{1, 1, 0}},      // Position of the unary '-'.
+		{"(x + y)", Position{1, 1, 0}}, // Position of the '('.
+		{"x\n + y", Position{2, 2, 3}},
+	}
+	for _, test := range tests {
+		e, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parsing %s: %v", test.expr, err)
+			continue
+		}
+		if got := e.Pos(); got != test.pos {
+			t.Errorf("Pos for %q: got %+v, want %+v", test.expr, got, test.pos)
+		}
+	}
+}
+
+func TestStringEval(t *testing.T) {
+	var tests = []struct {
+		expr   string
+		result string
+	}{
+		{`"hello"`, "hello"},
+		{`"a" + "b"`, "ab"},
+		{`"a" + "b" + "c"`, "abc"},
+		{`"line\n" + "tab\t" + "quote\"" + "back\\"`, "line\ntab\tquote\"back\\"},
+	}
+	for _, test := range tests {
+		e, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parsing %s: %v", test.expr, err)
+			continue
+		}
+		got, err := e.Eval(nil, ReturnError)
+		if err != nil {
+			t.Errorf("Evaluating %s: %v", test.expr, err)
+			continue
+		}
+		if !got.IsString() || got.Str() != test.result {
+			t.Errorf("Evaluating %s: got %v, want string %q", test.expr, got, test.result)
+		}
+	}
+
+	var cmpTests = []struct {
+		expr   string
+		result int
+	}{
+		{`"abc" == "abc"`, 1},
+		{`"abc" == "abd"`, 0},
+		{`"abc" != "abd"`, 1},
+		{`"abc" < "abd"`, 1},
+		{`"abd" > "abc"`, 1},
+		{`"abc" <= "abc"`, 1},
+		{`"abc" >= "abc"`, 1},
+	}
+	for _, test := range cmpTests {
+		e, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parsing %s: %v", test.expr, err)
+			continue
+		}
+		got, err := e.EvalInt(nil, ReturnError)
+		if err != nil {
+			t.Errorf("Evaluating %s: %v", test.expr, err)
+			continue
+		}
+		if got != test.result {
+			t.Errorf("Evaluating %s: got %d, want %d", test.expr, got, test.result)
+		}
+	}
+}
+
+func TestTypeMismatchError(t *testing.T) {
+	var tests = []struct {
+		expr string
+		err  string
+	}{
+		{`1 + "a"`, `expr:1:3: type mismatch: cannot add int and string`},
+		{`"a" - 1`, `expr:1:1: type mismatch: expected int, got string`},
+		{`1 == "a"`, `expr:1:3: type mismatch: cannot compare int and string`},
+		{`"a" * 2`, `expr:1:1: type mismatch: expected int, got string`},
+	}
+	for _, test := range tests {
+		e, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parsing %s: %v", test.expr, err)
+			continue
+		}
+		_, err = e.Eval(nil, ReturnError)
+		if err == nil {
+			t.Errorf("Evaluating %s: no error", test.expr)
+			continue
+		}
+		if got := err.Error(); got != test.err {
+			t.Errorf("Wrong error for %s: got %q, want %q", test.expr, got, test.err)
+		}
+	}
+
+	// ReturnZero must not panic on a type mismatch.
+	e, err := Parse(`1 + "a"`)
+	if err != nil {
+		t.Fatalf("Parsing: %v", err)
+	}
+	got, err := e.EvalInt(nil, ReturnZero)
+	if err != nil {
+		t.Errorf("Evaluating with ReturnZero: %v", err)
+	}
+	if got != 0 {
+		t.Errorf("Evaluating with ReturnZero: got %d, want 0", got)
+	}
+}
+
+func TestEvalIntOnStringResult(t *testing.T) {
+	e, err := Parse(`"hello"`)
+	if err != nil {
+		t.Fatalf("Parsing: %v", err)
+	}
+	_, err = e.EvalInt(nil, ReturnError)
+	if err == nil {
+		t.Errorf("EvalInt on a string result: no error")
+	}
+}
+
+func TestLetEval(t *testing.T) {
+	var tests = []struct {
+		expr string
+		vars map[string]int
+		want int
+	}{
+		{"let x = 3 + 4 in x * x", nil, 49},
+		{"let x = 1 in let y = 2 in x + y", nil, 3},
+		// The let body can still see outer vars.
+		{"let x = 1 in x + y", map[string]int{"y": 10}, 11},
+		// A let binding shadows a var of the same name, but only inside its body.
+		{"let x = 5 in (let x = 10 in x) + x", nil, 15},
+		{"x", map[string]int{"x": 1}, 1},
+		{"(let x = 2 in x) + x", map[string]int{"x": 100}, 102},
+	}
+	for _, test := range tests {
+		e, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parsing %s: %v", test.expr, err)
+			continue
+		}
+		got, err := e.EvalInt(test.vars, ReturnError)
+		if err != nil {
+			t.Errorf("Evaluating %s: %v", test.expr, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Evaluating %s: got %d, want %d", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestTernaryEval(t *testing.T) {
+	var tests = []struct {
+		expr string
+		vars map[string]int
+		want int
+	}{
+		{"1 ? 2 : 3", nil, 2},
+		{"0 ? 2 : 3", nil, 3},
+		{"x > y ? x : y", map[string]int{"x": 1, "y": 2}, 2},
+		{"x > y ? x : y", map[string]int{"x": 3, "y": 2}, 3},
+	}
+	for _, test := range tests {
+		e, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parsing %s: %v", test.expr, err)
+			continue
+		}
+		got, err := e.EvalInt(test.vars, ReturnError)
+		if err != nil {
+			t.Errorf("Evaluating %s: %v", test.expr, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Evaluating %s: got %d, want %d", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestTernaryShortCircuit(t *testing.T) {
+	// The untaken branch must never be evaluated, under either ErrorMode:
+	// its division by zero must not surface as an error or a panic.
+	var tests = []struct {
+		expr string
+		want int
+	}{
+		{"1 ? 2 : 3/0", 2},
+		{"0 ? 1/0 : 2", 2},
+	}
+	for _, mode := range []ErrorMode{ReturnError, ReturnZero} {
+		for _, test := range tests {
+			e, err := Parse(test.expr)
+			if err != nil {
+				t.Errorf("Parsing %s: %v", test.expr, err)
+				continue
+			}
+			got, err := e.EvalInt(nil, mode)
+			if err != nil {
+				t.Errorf("Evaluating %s: %v", test.expr, err)
+				continue
+			}
+			if got != test.want {
+				t.Errorf("Evaluating %s: got %d, want %d", test.expr, got, test.want)
+			}
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	e, err := Parse("x + 2 * 3")
+	if err != nil {
+		t.Fatalf("Parsing: %v", err)
+	}
+	var got []string
+	label := func(n *Expr) string {
+		if n.Op() != "" {
+			return n.Op()
+		}
+		if n.Ident() != "" {
+			return n.Ident()
+		}
+		return fmt.Sprint(n.Num())
+	}
+	Walk(e, func(n *Expr) bool {
+		got = append(got, "pre:"+label(n))
+		return true
+	}, func(n *Expr) {
+		got = append(got, "post:"+label(n))
+	})
+	want := []string{
+		"pre:+", "pre:x", "post:x", "pre:*", "pre:2", "post:2", "pre:3", "post:3", "post:*", "post:+",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Walk order: got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Walk order[%d]: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestWalkPreFalseSkipsChildren(t *testing.T) {
+	e, err := Parse("x + y")
+	if err != nil {
+		t.Fatalf("Parsing: %v", err)
+	}
+	var visited []string
+	Walk(e, func(n *Expr) bool {
+		visited = append(visited, n.Op()+n.Ident())
+		return n.Op() != "+"
+	}, nil)
+	if len(visited) != 1 || visited[0] != "+" {
+		t.Errorf("Walk with pre returning false: got %v, want to stop at the root", visited)
+	}
+}
+
+func TestFold(t *testing.T) {
+	var tests = []struct {
+		expr string
+		want string
+	}{
+		{"1 + 2 * 3", "7"},
+		{"x + 2 * 3", "(x + 6)"},
+		{"1 / 0", "(1 / 0)"},
+		{"x + 1/0", "(x + (1 / 0))"},
+		{"1 ? 2 : 3/0", "2"},
+		{"0 ? 1/0 : 2", "2"},
+		{"x ? 1/0 : 2", "(x ? (1 / 0) : 2)"},
+		{"let x = 1 + 2 in x * x", "(let x = 3 in (x * x))"},
+		{"f(1 + 2, x)", "f(3, x)"},
+		{"-(-5)", "5"},
+		{"1 << -1", "(1 << -1)"},
+	}
+	for _, test := range tests {
+		e, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parsing %s: %v", test.expr, err)
+			continue
+		}
+		got := e.Fold().String()
+		if got != test.want {
+			t.Errorf("Fold(%s): got %q, want %q", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestFoldPreservesEval(t *testing.T) {
+	var tests = []struct {
+		expr string
+		vars map[string]int
+	}{
+		{"1 + 2 * 3", nil},
+		{"x + 2 * 3", map[string]int{"x": 5}},
+		{"x ? 1/0 : 2", map[string]int{"x": 0}},
+		{"let x = 1 + 2 in x * x", nil},
+		{"x - -y", map[string]int{"x": 3, "y": 4}},
+		{"min(1 + 2, x)", map[string]int{"x": 0}},
+	}
+	for _, test := range tests {
+		e, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parsing %s: %v", test.expr, err)
+			continue
+		}
+		folded := e.Fold()
+		for _, mode := range []ErrorMode{ReturnError, ReturnZero} {
+			want, wantErr := e.EvalInt(test.vars, mode)
+			got, gotErr := folded.EvalInt(test.vars, mode)
+			if (gotErr == nil) != (wantErr == nil) {
+				t.Errorf("Fold(%s) error mismatch under mode %v: got %v, want %v", test.expr, mode, gotErr, wantErr)
+				continue
+			}
+			if gotErr == nil && got != want {
+				t.Errorf("Fold(%s) under mode %v: got %d, want %d", test.expr, mode, got, want)
+			}
+		}
+	}
+}
+
+func TestFoldDoesNotPanicOnZeroDivision(t *testing.T) {
+	e, err := Parse("1 / 0")
+	if err != nil {
+		t.Fatalf("Parsing: %v", err)
+	}
+	folded := e.Fold()
+	if _, err := folded.EvalInt(nil, ReturnError); err == nil {
+		t.Errorf("Evaluating folded 1/0 with ReturnError: no error")
+	}
+	got, err := folded.EvalInt(nil, ReturnZero)
+	if err != nil {
+		t.Errorf("Evaluating folded 1/0 with ReturnZero: %v", err)
+	}
+	if got != 0 {
+		t.Errorf("Evaluating folded 1/0 with ReturnZero: got %d, want 0", got)
+	}
+}
+
+func TestCompileRun(t *testing.T) {
+	var tests = []struct {
+		expr string
+		vars map[string]int
+		want int
+	}{
+		{"x*x + y*y", map[string]int{"x": 3, "y": 4}, 25},
+		{"x > y ? x : y", map[string]int{"x": 1, "y": 2}, 2},
+		{"let a = x + y in a * a", map[string]int{"x": 3, "y": 4}, 49},
+		{"let a = 1 in let b = 2 in a + b", nil, 3},
+		{"1 ? 2 : 3/0", nil, 2},
+		{"0 ? 1/0 : 2", nil, 2},
+		{"min(x, y) + max(x, y)", map[string]int{"x": 3, "y": 4}, 7},
+		{"abs(-5) + len(1, 2, 3)", nil, 8},
+		{"-x + ^y + !0", map[string]int{"x": 3, "y": 4}, -7},
+		{"x / 0", map[string]int{"x": 1}, 0},
+	}
+	for _, test := range tests {
+		e, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parsing %s: %v", test.expr, err)
+			continue
+		}
+		prog := e.Compile()
+		if test.expr == "x / 0" {
+			if _, err := prog.Run(test.vars, ReturnError); err == nil {
+				t.Errorf("Run(%s) with ReturnError: no error", test.expr)
+			}
+			continue
+		}
+		got, err := prog.Run(test.vars, ReturnError)
+		if err != nil {
+			t.Errorf("Run(%s): %v", test.expr, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Run(%s): got %d, want %d", test.expr, got, test.want)
+		}
+		// Run must agree with Eval.
+		want, err := e.EvalInt(test.vars, ReturnError)
+		if err != nil {
+			t.Errorf("EvalInt(%s): %v", test.expr, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("Run(%s) disagrees with Eval: got %d, want %d", test.expr, got, want)
+		}
+	}
+}
+
+func TestCompileShortCircuit(t *testing.T) {
+	// Unlike Eval, a Program short-circuits && and ||: the dead side's
+	// division by zero must never be reported.
+	var tests = []struct {
+		expr string
+		want int
+	}{
+		{"0 && 1/0", 0},
+		{"1 || 1/0", 1},
+	}
+	for _, mode := range []ErrorMode{ReturnError, ReturnZero} {
+		for _, test := range tests {
+			e, err := Parse(test.expr)
+			if err != nil {
+				t.Errorf("Parsing %s: %v", test.expr, err)
+				continue
+			}
+			got, err := e.Compile().Run(nil, mode)
+			if err != nil {
+				t.Errorf("Run(%s) under mode %v: %v", test.expr, mode, err)
+				continue
+			}
+			if got != test.want {
+				t.Errorf("Run(%s) under mode %v: got %d, want %d", test.expr, mode, got, test.want)
+			}
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	var tests = []struct {
+		expr string
+		err  string
+	}{
+		{"x / 0", `expr:1:3: division by zero`},
+		{"x << -1", `expr:1:3: negative left shift amount`},
+		{"undefinedvar", `expr:1:1: undefined variable undefinedvar`},
+	}
+	for _, test := range tests {
+		e, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parsing %s: %v", test.expr, err)
+			continue
+		}
+		_, err = e.Compile().Run(map[string]int{"x": 1}, ReturnError)
+		if err == nil {
+			t.Errorf("Run(%s): no error", test.expr)
+			continue
+		}
+		if got := err.Error(); got != test.err {
+			t.Errorf("Run(%s): got %q, want %q", test.expr, got, test.err)
+		}
+	}
+}
+
+func TestCompileNoDepthLimit(t *testing.T) {
+	// A Program has no fixed limit on call argument count or let-nesting
+	// depth, unlike the earlier bytecode VM it replaced: both of these used
+	// to overflow a fixed-size 8-element stack.
+	var tests = []struct {
+		expr string
+		want int
+	}{
+		{"len(1,2,3,4,5,6,7,8,9)", 9},
+		{"let a=1 in let b=a+1 in let c=b+1 in let d=c+1 in " +
+			"let e=d+1 in let f=e+1 in let g=f+1 in let h=g+1 in " +
+			"let i=h+1 in i", 9},
+	}
+	for _, test := range tests {
+		e, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parsing %s: %v", test.expr, err)
+			continue
+		}
+		got, err := e.Compile().Run(nil, ReturnError)
+		if err != nil {
+			t.Errorf("Run(%s): %v", test.expr, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Run(%s): got %d, want %d", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestCompilePanicsOnString(t *testing.T) {
+	e, err := Parse(`"hello"`)
+	if err != nil {
+		t.Fatalf("Parsing: %v", err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Compile on a string literal: no panic")
+		}
+	}()
+	e.Compile()
+}
+
+func TestCompilePanicsOnUndefinedFunction(t *testing.T) {
+	e, err := Parse("nope(x)")
+	if err != nil {
+		t.Fatalf("Parsing: %v", err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Compile on a call to an undefined function: no panic")
+		}
+	}()
+	e.Compile()
+}
+
+func TestBindRunWith(t *testing.T) {
+	e, err := Parse("x*x + y*y")
+	if err != nil {
+		t.Fatalf("Parsing: %v", err)
+	}
+	prog := e.Bind([]string{"x", "y"})
+	got, err := prog.RunWith([]int{3, 4}, ReturnError)
+	if err != nil {
+		t.Fatalf("RunWith: %v", err)
+	}
+	if got != 25 {
+		t.Errorf("RunWith: got %d, want 25", got)
+	}
+}
+
+func TestBindUnknownVariablePanics(t *testing.T) {
+	e, err := Parse("x + y")
+	if err != nil {
+		t.Fatalf("Parsing: %v", err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Bind with an undeclared variable: no panic")
+		}
+	}()
+	e.Bind([]string{"x"})
+}
+
+func TestRunBindMismatchPanics(t *testing.T) {
+	e, err := Parse("x")
+	if err != nil {
+		t.Fatalf("Parsing: %v", err)
+	}
+	t.Run("Run on a Bind Program", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("no panic")
+			}
+		}()
+		e.Bind([]string{"x"}).Run(map[string]int{"x": 1}, ReturnError)
+	})
+	t.Run("RunWith on a Compile Program", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("no panic")
+			}
+		}()
+		e.Compile().RunWith([]int{1}, ReturnError)
+	})
+}
+
+func BenchmarkEvalXXPlusYY(b *testing.B) {
+	e, err := Parse("x*x + y*y")
+	if err != nil {
+		b.Fatal(err)
+	}
+	vars := map[string]int{"x": 3, "y": 4}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := e.EvalInt(vars, ReturnError); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRunXXPlusYY(b *testing.B) {
+	e, err := Parse("x*x + y*y")
+	if err != nil {
+		b.Fatal(err)
+	}
+	prog := e.Compile()
+	vars := map[string]int{"x": 3, "y": 4}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := prog.Run(vars, ReturnError); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRunWithXXPlusYY(b *testing.B) {
+	e, err := Parse("x*x + y*y")
+	if err != nil {
+		b.Fatal(err)
+	}
+	prog := e.Bind([]string{"x", "y"})
+	vals := []int{3, 4}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := prog.RunWith(vals, ReturnError); err != nil {
+			b.Fatal(err)
+		}
+	}
+}